@@ -0,0 +1,235 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Package storefetch downloads CockroachDB store archives from cloud object
+// storage in parallel, with retry/backoff and a post-download checksum log,
+// streaming objects through the existing storageccl ExternalStorage
+// interface. It exists to replace the `gsutil -m cp -r` shell-out the
+// acceptance benchmarks used to bootstrap remote test clusters, which
+// required gsutil to be installed on every node and gave up entirely on the
+// first transient error.
+package storefetch
+
+import (
+	"context"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+)
+
+// ExternalStore is the subset of storageccl.ExternalStorage a Download
+// needs. Any ExternalStorage implementation (gs://, s3://, azure://)
+// satisfies this directly, so this package doesn't need to import the
+// CCL-only storageccl package; callers construct their own ExternalStorage
+// and pass it in.
+type ExternalStore interface {
+	// ListFiles returns the name of every object under the store's prefix
+	// matching pattern ("" matches everything).
+	ListFiles(ctx context.Context, pattern string) ([]string, error)
+	// Size returns the size in bytes of the named object.
+	Size(ctx context.Context, basename string) (int64, error)
+	// ReadFile opens a streaming read of the named object from the start.
+	ReadFile(ctx context.Context, basename string) (io.ReadCloser, error)
+}
+
+// ProgressFunc is called as chunks of an object are downloaded, so a caller
+// can report MB/s and ETA.
+type ProgressFunc func(object string, bytesDone, bytesTotal int64)
+
+// Options configures Download.
+type Options struct {
+	// Workers is the size of the worker pool objects are sharded across. Zero
+	// uses 4 * runtime.NumCPU().
+	Workers int
+	// Progress, if set, is called as objects are downloaded.
+	Progress ProgressFunc
+}
+
+const defaultWorkersPerCPU = 4
+
+// Download fetches every object exposed by store into destDir, preserving
+// the object names as relative paths. Objects are sharded across a worker
+// pool; transient errors are retried with exponential backoff and jitter;
+// and each completed object's CRC32C is logged (ExternalStorage has no
+// stored checksum to verify against, so this is informational, not a
+// verify-before-ingest check).
+func Download(ctx context.Context, store ExternalStore, destDir string, opts Options) error {
+	names, err := store.ListFiles(ctx, "")
+	if err != nil {
+		return err
+	}
+
+	workers := opts.Workers
+	if workers == 0 {
+		workers = defaultWorkersPerCPU * runtime.NumCPU()
+	}
+	if workers > len(names) {
+		workers = len(names)
+	}
+
+	work := make(chan string)
+	var wg sync.WaitGroup
+	errs := make(chan error, len(names))
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for name := range work {
+				errs <- downloadOne(ctx, store, destDir, name, opts.Progress)
+			}
+		}()
+	}
+	for _, name := range names {
+		select {
+		case work <- name:
+		case <-ctx.Done():
+			close(work)
+			wg.Wait()
+			return ctx.Err()
+		}
+	}
+	close(work)
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+const (
+	maxAttempts     = 5
+	downloadBufSize = 1 << 20 // 1MB
+)
+
+// initialBackoff and maxBackoff are vars (rather than consts) so tests can
+// shrink them instead of sleeping through real retry delays.
+var (
+	initialBackoff = 500 * time.Millisecond
+	maxBackoff     = 30 * time.Second
+)
+
+// downloadOne fetches a single object, retrying transient errors with
+// exponential backoff and jitter, and logging the result's CRC32C once
+// complete.
+func downloadOne(
+	ctx context.Context, store ExternalStore, destDir, name string, progress ProgressFunc,
+) error {
+	dest := filepath.Join(destDir, name)
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
+
+	size, err := store.Size(ctx, name)
+	if err != nil {
+		return err
+	}
+
+	backoff := initialBackoff
+	var lastErr error
+	for attempt := 1; attempt <= maxAttempts; attempt++ {
+		if err := downloadOnce(ctx, store, dest, name, size, progress); err != nil {
+			lastErr = err
+			if attempt == maxAttempts {
+				break
+			}
+			jitter := time.Duration(rand.Int63n(int64(backoff)))
+			wait := backoff + jitter
+			log.Warningf(ctx, "storefetch: retrying %s in %s: %s", name, wait, err)
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(wait):
+			}
+			if backoff *= 2; backoff > maxBackoff {
+				backoff = maxBackoff
+			}
+			continue
+		}
+		lastErr = nil
+		break
+	}
+	if lastErr != nil {
+		return fmt.Errorf("downloading %s after %d attempts: %s", name, maxAttempts, lastErr)
+	}
+
+	crc, err := crc32cFile(dest)
+	if err != nil {
+		return err
+	}
+	log.Infof(ctx, "storefetch: downloaded %s (crc32c=%x)", name, crc)
+	return nil
+}
+
+// downloadOnce streams object name from store into dest in one pass.
+func downloadOnce(
+	ctx context.Context,
+	store ExternalStore,
+	dest, name string,
+	size int64,
+	progress ProgressFunc,
+) error {
+	r, err := store.ReadFile(ctx, name)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	f, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	buf := make([]byte, downloadBufSize)
+	var done int64
+	for {
+		n, rerr := r.Read(buf)
+		if n > 0 {
+			if _, werr := f.Write(buf[:n]); werr != nil {
+				return werr
+			}
+			done += int64(n)
+			if progress != nil {
+				progress(name, done, size)
+			}
+		}
+		if rerr == io.EOF {
+			return nil
+		}
+		if rerr != nil {
+			return rerr
+		}
+	}
+}
+
+// crc32cFile computes the CRC32C (Castagnoli) checksum of the file at path.
+func crc32cFile(path string) (uint32, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	h := crc32.New(crc32.MakeTable(crc32.Castagnoli))
+	if _, err := io.Copy(h, f); err != nil {
+		return 0, err
+	}
+	return h.Sum32(), nil
+}
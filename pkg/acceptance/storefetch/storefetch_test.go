@@ -0,0 +1,170 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+package storefetch
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// swapBackoffForTest shrinks initialBackoff/maxBackoff so retry tests don't
+// sleep through real backoff delays, returning a func that restores them.
+func swapBackoffForTest() func() {
+	prevInitial, prevMax := initialBackoff, maxBackoff
+	initialBackoff, maxBackoff = time.Millisecond, 10*time.Millisecond
+	return func() { initialBackoff, maxBackoff = prevInitial, prevMax }
+}
+
+// fakeStore is an in-memory ExternalStore backed by a name -> contents map,
+// optionally failing the first N reads of each object to exercise retries.
+type fakeStore struct {
+	files map[string][]byte
+
+	mu        sync.Mutex
+	failsLeft map[string]int
+}
+
+func (s *fakeStore) ListFiles(ctx context.Context, pattern string) ([]string, error) {
+	names := make([]string, 0, len(s.files))
+	for name := range s.files {
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+func (s *fakeStore) Size(ctx context.Context, basename string) (int64, error) {
+	data, ok := s.files[basename]
+	if !ok {
+		return 0, errors.New("not found")
+	}
+	return int64(len(data)), nil
+}
+
+func (s *fakeStore) ReadFile(ctx context.Context, basename string) (io.ReadCloser, error) {
+	data, ok := s.files[basename]
+	if !ok {
+		return nil, errors.New("not found")
+	}
+
+	s.mu.Lock()
+	if s.failsLeft[basename] > 0 {
+		s.failsLeft[basename]--
+		s.mu.Unlock()
+		return nil, errors.New("injected transient error")
+	}
+	s.mu.Unlock()
+
+	return ioutil.NopCloser(bytes.NewReader(data)), nil
+}
+
+func TestDownload(t *testing.T) {
+	store := &fakeStore{
+		files: map[string][]byte{
+			"node0/COCKROACHDB_VERSION": []byte("v1.0"),
+			"node1/COCKROACHDB_VERSION": []byte("v1.0"),
+			"node0/000001.sst":          bytes.Repeat([]byte("x"), downloadBufSize+17),
+		},
+	}
+
+	destDir, err := ioutil.TempDir("", "storefetch-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var progressCalls int32
+	opts := Options{
+		Workers:  2,
+		Progress: func(object string, bytesDone, bytesTotal int64) { atomic.AddInt32(&progressCalls, 1) },
+	}
+	if err := Download(context.Background(), store, destDir, opts); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, want := range store.files {
+		got, err := ioutil.ReadFile(filepath.Join(destDir, name))
+		if err != nil {
+			t.Fatalf("reading downloaded %s: %s", name, err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("%s: downloaded %d bytes, want %d", name, len(got), len(want))
+		}
+	}
+	if progressCalls == 0 {
+		t.Error("Progress was never called")
+	}
+}
+
+func TestDownloadRetriesTransientErrors(t *testing.T) {
+	defer swapBackoffForTest()()
+
+	store := &fakeStore{
+		files: map[string][]byte{
+			"node0/COCKROACHDB_VERSION": []byte("v1.0"),
+		},
+		failsLeft: map[string]int{"node0/COCKROACHDB_VERSION": maxAttempts - 1},
+	}
+
+	destDir, err := ioutil.TempDir("", "storefetch-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := downloadOne(context.Background(), store, destDir, "node0/COCKROACHDB_VERSION", nil); err != nil {
+		t.Fatalf("expected success within maxAttempts retries, got: %s", err)
+	}
+}
+
+func TestDownloadGivesUpAfterMaxAttempts(t *testing.T) {
+	defer swapBackoffForTest()()
+
+	store := &fakeStore{
+		files:     map[string][]byte{"f": []byte("data")},
+		failsLeft: map[string]int{"f": maxAttempts},
+	}
+
+	destDir, err := ioutil.TempDir("", "storefetch-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := downloadOne(context.Background(), store, destDir, "f", nil); err == nil {
+		t.Fatal("expected an error after exhausting all retries")
+	}
+}
+
+func TestDownloadRespectsCanceledContext(t *testing.T) {
+	store := &fakeStore{
+		files:     map[string][]byte{"f": []byte("data")},
+		failsLeft: map[string]int{"f": maxAttempts},
+	}
+
+	destDir, err := ioutil.TempDir("", "storefetch-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	start := time.Now()
+	if err := downloadOne(ctx, store, destDir, "f", nil); err != context.Canceled {
+		t.Fatalf("expected context.Canceled, got: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > initialBackoff {
+		t.Errorf("downloadOne blocked for %s after ctx was already canceled", elapsed)
+	}
+}
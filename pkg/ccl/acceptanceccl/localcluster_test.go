@@ -0,0 +1,167 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed under the Cockroach Community Licence (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://github.com/cockroachdb/cockroach/blob/master/LICENSE
+
+package acceptanceccl
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/cockroachdb/cockroach/pkg/base"
+	"github.com/cockroachdb/cockroach/pkg/testutils/serverutils"
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+)
+
+var (
+	benchRemote = flag.Bool("remote", false, "run the backup/restore benchmarks against a "+
+		"Terrafarm-provisioned cluster instead of a local, in-process one")
+	benchNodes    = flag.Int("nodes", 3, "number of nodes to use for a local (COCKROACH_BENCH_LOCAL) benchmark run")
+	benchStoreDir = flag.String("store-dir", "", "local directory, laid out like the store archives "+
+		"under storeURL (one nodeN subdirectory per node), to copy into each node's store before a "+
+		"local (COCKROACH_BENCH_LOCAL) benchmark run starts; empty skips the copy")
+)
+
+// benchLocalEnvVar, when set to any non-empty value, switches the
+// backup/restore benchmarks in this package from provisioning a real cluster
+// through Terrafarm to starting an in-process one (see localCluster below).
+// This lets contributors run them with plain `go test -bench` for regression
+// tracking on a laptop, without cloud credentials.
+const benchLocalEnvVar = "COCKROACH_BENCH_LOCAL"
+
+// useLocalCluster reports whether the backup/restore benchmarks should run
+// against a local cluster rather than provisioning VMs through Terrafarm.
+// -remote always wins, so a contributor who exports COCKROACH_BENCH_LOCAL
+// permanently can still ask a single run to use a real cluster.
+func useLocalCluster() bool {
+	if *benchRemote {
+		return false
+	}
+	return os.Getenv(benchLocalEnvVar) != ""
+}
+
+// localCluster is the in-process counterpart to terrafarm.Farmer: it backs a
+// benchmarkTest with a local TestCluster instead of cloud VMs, implementing
+// the same Start/Close/PGUrl/Kill/Restart surface the benchmarks need.
+type localCluster struct {
+	tc    serverutils.TestClusterInterface
+	nodes int
+	// storeDir, if set, is a local directory laid out like the store archives
+	// in storeURL (one `nodeN` subdirectory per node) that is copied into each
+	// node's store before the cluster starts.
+	storeDir string
+
+	// tempStoreDirs are the per-node temp directories Start copies storeDir
+	// into; Close removes them.
+	tempStoreDirs []string
+}
+
+func newLocalCluster(nodes int, storeDir string) *localCluster {
+	return &localCluster{nodes: nodes, storeDir: storeDir}
+}
+
+// Start brings up the local cluster, first copying any archived stores into
+// place so the nodes pick them up on their initial boot.
+func (lc *localCluster) Start(ctx context.Context, t testing.TB) {
+	args := base.TestClusterArgs{
+		ReplicationMode: base.ReplicationAuto,
+	}
+	if lc.storeDir != "" {
+		args.ServerArgsPerNode = make(map[int]base.TestServerArgs, lc.nodes)
+		for i := 0; i < lc.nodes; i++ {
+			storePath, err := ioutil.TempDir("", fmt.Sprintf("acceptanceccl-node%d-", i))
+			if err != nil {
+				t.Fatalf("creating local store dir for node %d: %s", i, err)
+			}
+			src := filepath.Join(lc.storeDir, fmt.Sprintf("node%d", i))
+			log.Infof(ctx, "copying local store archive %s -> %s", src, storePath)
+			if err := copyDir(src, storePath); err != nil {
+				t.Fatalf("copying local store archive for node %d: %s", i, err)
+			}
+			lc.tempStoreDirs = append(lc.tempStoreDirs, storePath)
+			args.ServerArgsPerNode[i] = base.TestServerArgs{
+				StoreSpecs: []base.StoreSpec{{Path: storePath}},
+			}
+		}
+	}
+
+	log.Infof(ctx, "starting local %d-node cluster", lc.nodes)
+	lc.tc = serverutils.StartTestCluster(t, lc.nodes, args)
+}
+
+// Close stops the cluster and releases its resources, including any temp
+// directories Start copied a store archive into.
+func (lc *localCluster) Close(ctx context.Context) {
+	if lc.tc != nil {
+		log.Infof(ctx, "stopping local cluster")
+		lc.tc.Stopper().Stop(ctx)
+	}
+	for _, dir := range lc.tempStoreDirs {
+		if err := os.RemoveAll(dir); err != nil {
+			log.Warningf(ctx, "removing temp store dir %s: %s", dir, err)
+		}
+	}
+}
+
+// NumNodes returns the number of nodes in the cluster.
+func (lc *localCluster) NumNodes() int {
+	return lc.nodes
+}
+
+// PGUrl returns a connection string for the i'th node.
+func (lc *localCluster) PGUrl(ctx context.Context, i int) string {
+	return fmt.Sprintf("postgres://root@%s?sslmode=disable", lc.tc.Server(i).ServingSQLAddr())
+}
+
+// Kill stops (without removing) the i'th node, simulating a node outage.
+func (lc *localCluster) Kill(ctx context.Context, i int) error {
+	lc.tc.StopServer(i)
+	return nil
+}
+
+// Restart restarts the i'th node after a Kill.
+func (lc *localCluster) Restart(ctx context.Context, i int) error {
+	return lc.tc.RestartServer(i)
+}
+
+// copyDir recursively copies the contents of src into dst, which must already
+// exist. It is used to stage a local store archive into a node's data
+// directory before the node is started.
+func copyDir(src, dst string) error {
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		if info.IsDir() {
+			return os.MkdirAll(target, info.Mode())
+		}
+		in, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+		out, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode())
+		if err != nil {
+			return err
+		}
+		defer out.Close()
+		_, err = io.Copy(out, in)
+		return err
+	})
+}
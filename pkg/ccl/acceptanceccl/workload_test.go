@@ -0,0 +1,224 @@
+// Copyright 2017 The Cockroach Authors.
+//
+// Licensed under the Cockroach Community Licence (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://github.com/cockroachdb/cockroach/blob/master/LICENSE
+
+package acceptanceccl
+
+import (
+	"flag"
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/jackc/pgx"
+
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+	"github.com/cockroachdb/cockroach/pkg/util/randutil"
+	"github.com/cockroachdb/cockroach/pkg/util/syncutil"
+	"github.com/cockroachdb/cockroach/pkg/util/timeutil"
+)
+
+// benchWorkloadQPS controls whether BenchmarkBackup2TB and BenchmarkRestoreBig
+// also drive a foreground KV workload while the job runs; 0 (the default)
+// disables it.
+var benchWorkloadQPS = flag.Int("workload-qps", 0, "aggregate QPS of a foreground "+
+	"KV workload to run concurrently with the backup/restore benchmarks in this package; 0 disables it")
+
+// workloadDistribution selects how a kvWorkload picks keys within its key
+// range.
+type workloadDistribution int
+
+const (
+	// workloadUniform picks keys uniformly at random.
+	workloadUniform workloadDistribution = iota
+	// workloadZipfian picks keys from a Zipfian distribution, concentrating
+	// load on a small "hot" range of keys the way many production workloads
+	// do.
+	workloadZipfian
+)
+
+// kvWorkload is a configurable foreground KV workload that a benchmark can
+// run concurrently with a BACKUP/RESTORE job, to measure how much the job
+// degrades regular SQL traffic. It opens independent pgx connections to
+// every node and reports latency/QPS as benchmark sub-metrics rather than
+// folding them into the job's own bytes/sec number.
+type kvWorkload struct {
+	// pgURLs is one connection string per node; workers are spread evenly
+	// across them.
+	pgURLs []string
+	// qps is the aggregate queries/sec the workload should attempt to sustain
+	// across all workers.
+	qps int
+	// readFraction is the fraction (0-1) of operations that are reads; the
+	// remainder are writes.
+	readFraction float64
+	// keyRange is the number of distinct keys the workload reads and writes.
+	keyRange int
+	// payloadSize is the size, in bytes, of the value written on each write.
+	payloadSize int
+	// distribution selects how keys are chosen within keyRange.
+	distribution workloadDistribution
+
+	stopper chan struct{}
+	wg      sync.WaitGroup
+
+	mu struct {
+		syncutil.Mutex
+		readLatencies  []time.Duration
+		writeLatencies []time.Duration
+		ops            int64
+	}
+}
+
+// Start clears any stats from a previous run and spawns the workload's worker
+// goroutines. It returns once all workers have connected and been started;
+// each issues its first query one tick of its QPS interval later.
+func (w *kvWorkload) Start(ctx context.Context) {
+	w.stopper = make(chan struct{})
+
+	w.mu.Lock()
+	w.mu.readLatencies, w.mu.writeLatencies, w.mu.ops = nil, nil, 0
+	w.mu.Unlock()
+
+	const workersPerNode = 4
+	perWorkerQPS := float64(w.qps) / float64(len(w.pgURLs)*workersPerNode)
+
+	for _, pgURL := range w.pgURLs {
+		pgURL := pgURL
+		connConfig, err := pgx.ParseURI(pgURL)
+		if err != nil {
+			log.Fatalf(ctx, "parsing workload pgURL %s: %s", pgURL, err)
+		}
+		for i := 0; i < workersPerNode; i++ {
+			conn, err := pgx.Connect(connConfig)
+			if err != nil {
+				log.Fatalf(ctx, "connecting workload worker to %s: %s", pgURL, err)
+			}
+			w.wg.Add(1)
+			go w.runWorker(ctx, conn, perWorkerQPS)
+		}
+	}
+}
+
+// Stop halts all worker goroutines and waits for them to exit.
+func (w *kvWorkload) Stop() {
+	close(w.stopper)
+	w.wg.Wait()
+}
+
+// WaitForOps blocks until the workload has completed at least n operations.
+// It's used by the incremental backup benchmarks to apply a fixed number of
+// mutations between a full and an incremental backup, rather than running
+// the workload for a fixed duration.
+func (w *kvWorkload) WaitForOps(n int64) {
+	for {
+		w.mu.Lock()
+		done := w.mu.ops >= n
+		w.mu.Unlock()
+		if done {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func (w *kvWorkload) runWorker(ctx context.Context, conn *pgx.Conn, qps float64) {
+	defer w.wg.Done()
+	defer conn.Close()
+
+	rng, _ := randutil.NewPseudoRand()
+	interval := time.Duration(float64(time.Second) / qps)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-w.stopper:
+			return
+		case <-ticker.C:
+			w.runOp(ctx, conn, rng)
+		}
+	}
+}
+
+func (w *kvWorkload) runOp(ctx context.Context, conn *pgx.Conn, rng *rand.Rand) {
+	key := w.pickKey(rng)
+	start := timeutil.Now()
+	var err error
+	isRead := rng.Float64() < w.readFraction
+	if isRead {
+		var payload string
+		err = conn.QueryRow(`SELECT payload FROM bench.bank WHERE id = $1`, key).Scan(&payload)
+	} else {
+		payload := randutil.RandBytes(rng, w.payloadSize)
+		_, err = conn.Exec(`UPSERT INTO bench.bank (id, balance, payload) VALUES ($1, 0, $2)`, key, payload)
+	}
+	latency := timeutil.Now().Sub(start)
+	if err != nil {
+		log.Warningf(ctx, "workload op failed: %s", err)
+		return
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.mu.ops++
+	if isRead {
+		w.mu.readLatencies = append(w.mu.readLatencies, latency)
+	} else {
+		w.mu.writeLatencies = append(w.mu.writeLatencies, latency)
+	}
+}
+
+func (w *kvWorkload) pickKey(rng *rand.Rand) int64 {
+	switch w.distribution {
+	case workloadZipfian:
+		z := rand.NewZipf(rng, 1.1, 1, uint64(w.keyRange-1))
+		return int64(z.Uint64())
+	default:
+		return rng.Int63n(int64(w.keyRange))
+	}
+}
+
+// reportMetrics emits the workload's achieved QPS and p50/p95/p99 latencies
+// as benchmark sub-metrics via b.ReportMetric, so they show up alongside
+// (but distinct from) the primary bytes/sec number the BACKUP/RESTORE job
+// reports.
+func (w *kvWorkload) reportMetrics(b *testing.B, elapsed time.Duration) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	qps := float64(w.mu.ops) / elapsed.Seconds()
+	b.ReportMetric(qps, "workload-qps")
+
+	reportLatencyPercentiles(b, "workload-read", w.mu.readLatencies)
+	reportLatencyPercentiles(b, "workload-write", w.mu.writeLatencies)
+}
+
+func reportLatencyPercentiles(b *testing.B, label string, latencies []time.Duration) {
+	if len(latencies) == 0 {
+		return
+	}
+	sorted := append([]time.Duration(nil), latencies...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	for _, p := range []struct {
+		name string
+		frac float64
+	}{
+		{"p50", 0.50},
+		{"p95", 0.95},
+		{"p99", 0.99},
+	} {
+		idx := int(p.frac * float64(len(sorted)-1))
+		b.ReportMetric(float64(sorted[idx].Nanoseconds())/1e6, fmt.Sprintf("%s-%s-ms", label, p.name))
+	}
+}